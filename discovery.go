@@ -0,0 +1,140 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// registryProxyDiscovery resolves the *url.URL of the registry-proxy that fronts a given
+// remote interdomain domain, so a single cmd-nsmgr-proxy deployment can forward to more
+// than one foreign domain instead of needing a static RegistryProxyURL per peer.
+type registryProxyDiscovery interface {
+	Resolve(ctx context.Context, domain string) (*url.URL, error)
+}
+
+// newRegistryProxyDiscovery builds a registryProxyDiscovery backend from a
+// RegistryProxyDiscovery env value such as "static://", "dns://" or "consul://addr".
+// An empty raw falls back to the static backend, preserving the historical behavior of
+// a single, fixed RegistryProxyURL.
+func newRegistryProxyDiscovery(raw string, static *url.URL) (registryProxyDiscovery, error) {
+	if raw == "" {
+		return staticRegistryProxyDiscovery{url: static}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid RegistryProxyDiscovery %q", raw)
+	}
+	switch u.Scheme {
+	case "", "static":
+		return staticRegistryProxyDiscovery{url: static}, nil
+	case "dns":
+		return dnsRegistryProxyDiscovery{}, nil
+	case "consul":
+		return consulRegistryProxyDiscovery{addr: u.Host}, nil
+	default:
+		return nil, errors.Errorf("unsupported RegistryProxyDiscovery scheme %q", u.Scheme)
+	}
+}
+
+// staticRegistryProxyDiscovery always resolves to the RegistryProxyURL given at startup,
+// regardless of domain. It is the pre-existing, single-peer behavior.
+type staticRegistryProxyDiscovery struct {
+	url *url.URL
+}
+
+func (d staticRegistryProxyDiscovery) Resolve(_ context.Context, _ string) (*url.URL, error) {
+	return d.url, nil
+}
+
+// dnsRegistryProxyDiscovery resolves a remote domain's registry-proxy via an SRV lookup
+// of _nsm-registry._tcp.<domain>.
+type dnsRegistryProxyDiscovery struct {
+	resolver *net.Resolver
+}
+
+func (d dnsRegistryProxyDiscovery) Resolve(ctx context.Context, domain string) (*url.URL, error) {
+	if domain == "" {
+		return nil, errors.New("dns registry-proxy discovery requires a non-empty domain")
+	}
+	resolver := d.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, addrs, err := resolver.LookupSRV(ctx, "nsm-registry", "tcp", domain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "SRV lookup of _nsm-registry._tcp.%s failed", domain)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no _nsm-registry._tcp.%s SRV records found", domain)
+	}
+	target := addrs[0]
+	return &url.URL{Scheme: "tcp", Host: fmt.Sprintf("%s:%d", trimTrailingDot(target.Target), target.Port)}, nil
+}
+
+func trimTrailingDot(s string) string {
+	if len(s) > 0 && s[len(s)-1] == '.' {
+		return s[:len(s)-1]
+	}
+	return s
+}
+
+// consulRegistryProxyDiscovery resolves a remote domain's registry-proxy by looking it up
+// as a Consul service named after the domain, via Consul's HTTP catalog API at addr.
+type consulRegistryProxyDiscovery struct {
+	addr string
+}
+
+type consulCatalogEntry struct {
+	ServiceAddress string `json:"ServiceAddress"`
+	ServicePort    int    `json:"ServicePort"`
+}
+
+func (d consulRegistryProxyDiscovery) Resolve(ctx context.Context, domain string) (*url.URL, error) {
+	if domain == "" {
+		return nil, errors.New("consul registry-proxy discovery requires a non-empty domain")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("http://%s/v1/catalog/service/%s", d.addr, domain), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building consul catalog request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "querying consul catalog for service %q", domain)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var entries []consulCatalogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, errors.Wrap(err, "decoding consul catalog response")
+	}
+	if len(entries) == 0 {
+		return nil, errors.Errorf("no consul service named %q found", domain)
+	}
+	return &url.URL{Scheme: "tcp", Host: fmt.Sprintf("%s:%d", entries[0].ServiceAddress, entries[0].ServicePort)}, nil
+}
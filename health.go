@@ -0,0 +1,217 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
+)
+
+const upstreamHealthCheckPeriod = 30 * time.Second
+
+// Names of the services whose health is reported on the grpc.health.v1.Health service.
+const (
+	networkServiceName                 = "networkservice.NetworkService"
+	networkServiceRegistryName         = "registry.NetworkServiceRegistry"
+	networkServiceEndpointRegistryName = "registry.NetworkServiceEndpointRegistry"
+)
+
+// healthServices lists every service name that is flipped together when the proxy
+// as a whole becomes ready or loses an upstream dial.
+var healthServices = []string{
+	networkServiceName,
+	networkServiceRegistryName,
+	networkServiceEndpointRegistryName,
+}
+
+// newHealthServer creates a grpc.health.v1.Health implementation with every tracked
+// service starting out NOT_SERVING until markServing is called once all of the proxy's
+// upstream dependencies are ready.
+func newHealthServer() *health.Server {
+	healthServer := health.NewServer()
+	for _, name := range healthServices {
+		healthServer.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+	return healthServer
+}
+
+// registerHealthServer registers healthServer as the grpc.health.v1.Health service on
+// server. It can be called again for a rebuilt server so the same healthServer keeps
+// backing both the grpc and the HTTP /healthz and /readyz endpoints across a reload.
+func registerHealthServer(server *grpc.Server, healthServer *health.Server) {
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+}
+
+// markServing flips every tracked service to SERVING. readiness calls it once the
+// upstream dials have succeeded and, with leader election enabled, this replica holds
+// the lease.
+func markServing(healthServer *health.Server) {
+	for _, name := range healthServices {
+		healthServer.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+}
+
+// markNotServing flips every tracked service to NOT_SERVING. Call it when an upstream
+// dial breaks so that mesh peers stop routing new requests through this proxy.
+func markNotServing(healthServer *health.Server) {
+	for _, name := range healthServices {
+		healthServer.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// serveHTTPHealth exposes plain HTTP /healthz and /readyz endpoints on listenOn so that
+// the kubelet can probe this proxy without a grpc-health-probe/SPIFFE mTLS client.
+// Both endpoints report the same state as the grpc.health.v1.Health service: 200 while
+// healthServer reports the networkServiceName service SERVING, 503 otherwise.
+func serveHTTPHealth(ctx context.Context, listenOn *url.URL, healthServer *health.Server) <-chan error {
+	errCh := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		resp, err := healthServer.Check(r.Context(), &grpc_health_v1.HealthCheckRequest{Service: networkServiceName})
+		if err != nil || resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	mux.HandleFunc("/healthz", handler)
+	mux.HandleFunc("/readyz", handler)
+
+	ln, err := net.Listen("tcp", listenOn.Host)
+	if err != nil {
+		errCh <- err
+		close(errCh)
+		return errCh
+	}
+
+	httpServer := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	return errCh
+}
+
+func logHealthErr(ctx context.Context, errCh <-chan error) {
+	go func() {
+		if err, ok := <-errCh; ok && err != nil {
+			log.FromContext(ctx).Errorf("health http server: %+v", err)
+		}
+	}()
+}
+
+// readiness combines the two independent conditions that gate whether this replica
+// reports SERVING: its upstream dials are healthy, and (when leader election is enabled)
+// it currently holds the lease. Either one going bad flips the grpc.health.v1.Health
+// service and the HTTP /healthz and /readyz endpoints to NOT_SERVING.
+type readiness struct {
+	healthServer *health.Server
+
+	mu          sync.Mutex
+	upstreamsOK bool
+	leaderOK    bool
+}
+
+// newReadiness builds a readiness tracker. leaderElectionEnabled false means leadership
+// is vacuously satisfied, matching the single-replica behavior of a proxy that never
+// opted into leader election.
+func newReadiness(healthServer *health.Server, leaderElectionEnabled bool) *readiness {
+	return &readiness{
+		healthServer: healthServer,
+		upstreamsOK:  true,
+		leaderOK:     !leaderElectionEnabled,
+	}
+}
+
+func (r *readiness) setUpstreamsOK(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstreamsOK = ok
+	r.recomputeLocked()
+}
+
+func (r *readiness) setLeader(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leaderOK = ok
+	r.recomputeLocked()
+}
+
+func (r *readiness) recomputeLocked() {
+	if r.upstreamsOK && r.leaderOK {
+		markServing(r.healthServer)
+	} else {
+		markNotServing(r.healthServer)
+	}
+}
+
+// monitorUpstreams re-dials whatever targetsFn currently returns using dialOptions and
+// reports the result to readiness, immediately and then on every tick thereafter. targetsFn
+// is re-invoked on every check so a reload that changes RegistryURL/RegistryProxyURL is
+// picked up without a restart. It runs until ctx is Done.
+func monitorUpstreams(ctx context.Context, readiness *readiness, dialOptions []grpc.DialOption, targetsFn func() []*url.URL) {
+	readiness.setUpstreamsOK(upstreamsReachable(ctx, dialOptions, targetsFn()...))
+
+	ticker := time.NewTicker(upstreamHealthCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			readiness.setUpstreamsOK(upstreamsReachable(ctx, dialOptions, targetsFn()...))
+		}
+	}
+}
+
+func upstreamsReachable(ctx context.Context, dialOptions []grpc.DialOption, targets ...*url.URL) bool {
+	for _, target := range targets {
+		if target == nil {
+			continue
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+		cc, err := grpc.DialContext(dialCtx, target.String(), dialOptions...)
+		cancel()
+		if err != nil {
+			log.FromContext(ctx).Debugf("upstream %v is unreachable: %+v", target, err)
+			return false
+		}
+		_ = cc.Close()
+	}
+	return true
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/networkservice/chains/nsmgr"
+	"github.com/NikitaSkrynnik/sdk/pkg/networkservice/chains/nsmgrproxy"
+	"github.com/NikitaSkrynnik/sdk/pkg/registry/common/authorize"
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/interdomain"
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/spiffejwt"
+	registryapi "github.com/networkservicemesh/api/pkg/api/registry"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// interdomainRouter fronts however many foreign domains show up in incoming interdomain
+// registry requests from a single nsmgr-proxy deployment. The registry-proxy for a request
+// is resolved from its interdomain target domain (see interdomain.Domain) via discovery on
+// every request, instead of once at startup/reload from a single static RegistryProxyURL,
+// so proxies for multiple peers can coexist without a dedicated deployment per peer and
+// DNS/Consul changes are picked up without a reload. The nsmgrproxy chain built for a
+// resolved domain is cached and reused as long as discovery keeps resolving it to the same
+// URL, so OPA authorization, map-ip swapping and interdomain forwarding keep working
+// exactly as they do for a single static peer, just multiplexed across domains.
+type interdomainRouter struct {
+	ctx              context.Context
+	source           *workloadapi.X509Source
+	dialOptions      []grpc.DialOption
+	discovery        registryProxyDiscovery
+	fallbackProxyURL *url.URL
+	registryURL      *url.URL
+	name             string
+	listenURL        *url.URL
+	mapIPFilePath    string
+	maxTokenLifetime time.Duration
+
+	registryServerPolicies []string
+	registryClientPolicies []string
+
+	mu      sync.Mutex
+	proxies map[string]*domainProxy
+}
+
+// domainProxy is the cached nsmgrproxy chain for a domain, together with the registry-proxy
+// URL it was built with, so forDomain can tell a discovery change from a cache hit.
+type domainProxy struct {
+	proxyURL *url.URL
+	nsmgr    nsmgr.Nsmgr
+}
+
+// discoveryResolveTimeout bounds how long forDomain waits on discovery.Resolve. A dns:// SRV
+// lookup or a consul:// HTTP call can otherwise block indefinitely, and forDomain is called
+// on every interdomain registry RPC, not just once at startup/reload.
+const discoveryResolveTimeout = 5 * time.Second
+
+// newInterdomainRouter builds a router that resolves registry-proxies via discovery,
+// falling back to fallbackProxyURL for purely local (non-interdomain) requests. The
+// remaining arguments are forwarded to nsmgrproxy.NewServer unchanged for every domain.
+func newInterdomainRouter(
+	ctx context.Context,
+	source *workloadapi.X509Source,
+	dialOptions []grpc.DialOption,
+	discovery registryProxyDiscovery,
+	fallbackProxyURL, registryURL *url.URL,
+	name string,
+	listenURL *url.URL,
+	mapIPFilePath string,
+	maxTokenLifetime time.Duration,
+	registryServerPolicies, registryClientPolicies []string,
+) *interdomainRouter {
+	return &interdomainRouter{
+		ctx:                    ctx,
+		source:                 source,
+		dialOptions:            dialOptions,
+		discovery:              discovery,
+		fallbackProxyURL:       fallbackProxyURL,
+		registryURL:            registryURL,
+		name:                   name,
+		listenURL:              listenURL,
+		mapIPFilePath:          mapIPFilePath,
+		maxTokenLifetime:       maxTokenLifetime,
+		registryServerPolicies: registryServerPolicies,
+		registryClientPolicies: registryClientPolicies,
+		proxies:                make(map[string]*domainProxy),
+	}
+}
+
+// forDomain resolves the registry-proxy for domain via discovery on every call (bounded by
+// discoveryResolveTimeout, derived from ctx) and returns the nsmgrproxy chain for it, reusing
+// the cached chain only if discovery still resolves domain to the same URL it was built with.
+// This keeps discovery genuinely per-request, so DNS/Consul changes for an already-seen domain
+// take effect on the next call, while still avoiding rebuilding the whole OPA/map-ip/dial chain
+// when nothing has changed. domain is the empty string for a purely local, non-interdomain
+// request, in which case fallbackProxyURL is used without consulting discovery.
+func (router *interdomainRouter) forDomain(ctx context.Context, domain string) (nsmgr.Nsmgr, error) {
+	proxyURL := router.fallbackProxyURL
+	if domain != "" {
+		resolveCtx, cancel := context.WithTimeout(ctx, discoveryResolveTimeout)
+		resolved, err := router.discovery.Resolve(resolveCtx, domain)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		proxyURL = resolved
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if cached, ok := router.proxies[domain]; ok && sameURL(cached.proxyURL, proxyURL) {
+		return cached.nsmgr, nil
+	}
+
+	p := nsmgrproxy.NewServer(
+		router.ctx,
+		router.registryURL,
+		proxyURL,
+		spiffejwt.TokenGeneratorFunc(router.source, router.maxTokenLifetime),
+		nsmgrproxy.WithName(router.name),
+		nsmgrproxy.WithListenOn(router.listenURL),
+		nsmgrproxy.WithDialOptions(router.dialOptions...),
+		nsmgrproxy.WithMapIPFilePath(router.mapIPFilePath),
+		nsmgrproxy.WithAuthorizeNSERegistryServer(authorize.NewNetworkServiceEndpointRegistryServer(authorize.WithPolicies(
+			router.registryServerPolicies...))),
+		nsmgrproxy.WithAuthorizeNSERegistryClient(authorize.NewNetworkServiceEndpointRegistryClient(authorize.WithPolicies(
+			router.registryClientPolicies...))),
+		nsmgrproxy.WithAuthorizeNSRegistryServer(authorize.NewNetworkServiceRegistryServer(authorize.WithPolicies(
+			router.registryServerPolicies...))),
+		nsmgrproxy.WithAuthorizeNSRegistryClient(authorize.NewNetworkServiceRegistryClient(authorize.WithPolicies(
+			router.registryClientPolicies...))),
+	)
+	router.proxies[domain] = &domainProxy{proxyURL: proxyURL, nsmgr: p}
+	return p, nil
+}
+
+// resolvedProxyURLs returns the registry-proxy URL currently cached for every domain this
+// router has resolved, so proxyRunner.registryTargets can include them in the set that
+// monitorUpstreams dials on every health check.
+func (router *interdomainRouter) resolvedProxyURLs() []*url.URL {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	urls := make([]*url.URL, 0, len(router.proxies))
+	for _, p := range router.proxies {
+		urls = append(urls, p.proxyURL)
+	}
+	return urls
+}
+
+// sameURL reports whether a and b refer to the same registry-proxy, treating nil as only
+// equal to nil.
+func sameURL(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// Register wires the router's own per-request-resolving NetworkServiceRegistryServer and
+// NetworkServiceEndpointRegistryServer onto s, in place of a single static nsmgrproxy chain.
+func (router *interdomainRouter) Register(s *grpc.Server) {
+	registryapi.RegisterNetworkServiceRegistryServer(s, &interdomainNSServer{router: router})
+	registryapi.RegisterNetworkServiceEndpointRegistryServer(s, &interdomainNSEServer{router: router})
+}
+
+type interdomainNSServer struct {
+	router *interdomainRouter
+}
+
+func (s *interdomainNSServer) Register(ctx context.Context, ns *registryapi.NetworkService) (*registryapi.NetworkService, error) {
+	p, err := s.router.forDomain(ctx, interdomain.Domain(ns.Name))
+	if err != nil {
+		return nil, err
+	}
+	return p.NetworkServiceRegistryServer().Register(ctx, ns)
+}
+
+func (s *interdomainNSServer) Find(q *registryapi.NetworkServiceQuery, stream registryapi.NetworkServiceRegistry_FindServer) error {
+	var name string
+	if q.NetworkService != nil {
+		name = q.NetworkService.Name
+	}
+	p, err := s.router.forDomain(stream.Context(), interdomain.Domain(name))
+	if err != nil {
+		return err
+	}
+	return p.NetworkServiceRegistryServer().Find(q, stream)
+}
+
+func (s *interdomainNSServer) Unregister(ctx context.Context, ns *registryapi.NetworkService) (*emptypb.Empty, error) {
+	p, err := s.router.forDomain(ctx, interdomain.Domain(ns.Name))
+	if err != nil {
+		return nil, err
+	}
+	return p.NetworkServiceRegistryServer().Unregister(ctx, ns)
+}
+
+type interdomainNSEServer struct {
+	router *interdomainRouter
+}
+
+func (s *interdomainNSEServer) Register(ctx context.Context, nse *registryapi.NetworkServiceEndpoint) (*registryapi.NetworkServiceEndpoint, error) {
+	p, err := s.router.forDomain(ctx, interdomain.Domain(nse.Name))
+	if err != nil {
+		return nil, err
+	}
+	return p.NetworkServiceEndpointRegistryServer().Register(ctx, nse)
+}
+
+func (s *interdomainNSEServer) Find(q *registryapi.NetworkServiceEndpointQuery, stream registryapi.NetworkServiceEndpointRegistry_FindServer) error {
+	var name string
+	if q.NetworkServiceEndpoint != nil {
+		name = q.NetworkServiceEndpoint.Name
+	}
+	p, err := s.router.forDomain(stream.Context(), interdomain.Domain(name))
+	if err != nil {
+		return err
+	}
+	return p.NetworkServiceEndpointRegistryServer().Find(q, stream)
+}
+
+func (s *interdomainNSEServer) Unregister(ctx context.Context, nse *registryapi.NetworkServiceEndpoint) (*emptypb.Empty, error) {
+	p, err := s.router.forDomain(ctx, interdomain.Domain(nse.Name))
+	if err != nil {
+		return nil, err
+	}
+	return p.NetworkServiceEndpointRegistryServer().Unregister(ctx, nse)
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
+)
+
+const (
+	leaseDuration       = 15 * time.Second
+	leaseRenewPeriod    = 5 * time.Second
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// leaderElector decides which of several cmd-nsmgr-proxy replicas is allowed to mutate
+// interdomain registry state. onChanged is invoked every time the outcome changes.
+type leaderElector interface {
+	Run(ctx context.Context, onChanged func(isLeader bool)) error
+}
+
+// noopLeaderElector is used when LeaderElection is disabled: every replica is the leader.
+type noopLeaderElector struct{}
+
+func (noopLeaderElector) Run(ctx context.Context, onChanged func(isLeader bool)) error {
+	onChanged(true)
+	<-ctx.Done()
+	return nil
+}
+
+// leaderState tracks the current leadership outcome and gates registry write RPCs on it
+// via leaderUnaryInterceptor, so that only the leader replica mutates interdomain
+// registry state; the rest reply with Unavailable. The reply does not name the leader or
+// forward the write to it.
+type leaderState struct {
+	isLeader int32
+}
+
+func (s *leaderState) set(isLeader bool) {
+	v := int32(0)
+	if isLeader {
+		v = 1
+	}
+	atomic.StoreInt32(&s.isLeader, v)
+}
+
+func (s *leaderState) IsLeader() bool {
+	return atomic.LoadInt32(&s.isLeader) == 1
+}
+
+// registryWriteMethods are the full grpc method names this proxy refuses on a
+// non-leader replica.
+var registryWriteMethods = map[string]struct{}{
+	"/registry.NetworkServiceRegistry/Register":           {},
+	"/registry.NetworkServiceRegistry/Unregister":         {},
+	"/registry.NetworkServiceEndpointRegistry/Register":   {},
+	"/registry.NetworkServiceEndpointRegistry/Unregister": {},
+}
+
+// leaderUnaryInterceptor refuses registry write RPCs with Unavailable on any replica that
+// isn't currently the leader.
+func leaderUnaryInterceptor(state *leaderState) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, isWrite := registryWriteMethods[info.FullMethod]; isWrite && !state.IsLeader() {
+			return nil, status.Error(codes.Unavailable, "this replica is not the leader; retry the registry write against the leader")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// newLeaderElector builds a leaderElector from Config. LeaderElection=false keeps the
+// pre-existing single-replica behavior where every instance serves registry writes.
+func newLeaderElector(config *Config, identity string) leaderElector {
+	if !config.LeaderElection {
+		return noopLeaderElector{}
+	}
+	return &k8sLeaseLeaderElector{
+		namespace: config.LeaderElectionNamespace,
+		leaseName: config.LeaderElectionLeaseName,
+		identity:  identity,
+	}
+}
+
+// k8sLeaseLeaderElector implements leaderElector on top of a coordination.k8s.io/v1 Lease
+// object, reusing the pod's in-cluster service account to talk to the API server directly
+// over REST so this cmd doesn't have to pull in client-go.
+type k8sLeaseLeaderElector struct {
+	namespace string
+	leaseName string
+	identity  string
+}
+
+type leaseRequest struct {
+	HolderIdentity       *string `json:"holderIdentity"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds"`
+	RenewTime            *string `json:"renewTime"`
+}
+
+type leaseObject struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec leaseRequest `json:"spec"`
+}
+
+func (e *k8sLeaseLeaderElector) Run(ctx context.Context, onChanged func(isLeader bool)) error {
+	client, err := newInClusterClient()
+	if err != nil {
+		return err
+	}
+
+	wasLeader := false
+	ticker := time.NewTicker(leaseRenewPeriod)
+	defer ticker.Stop()
+	for {
+		isLeader, err := client.tryAcquireOrRenew(ctx, e.namespace, e.leaseName, e.identity)
+		if err != nil {
+			log.FromContext(ctx).Errorf("leader election: %+v", err)
+			isLeader = false
+		}
+		if isLeader != wasLeader {
+			onChanged(isLeader)
+			wasLeader = isLeader
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// inClusterClient is a minimal Kubernetes REST client for the single Lease
+// read-modify-write this package needs.
+type inClusterClient struct {
+	host  string
+	http  *http.Client
+	token string
+}
+
+func newInClusterClient() (*inClusterClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("leader election requires running in-cluster (KUBERNETES_SERVICE_HOST/PORT not set)")
+	}
+	token, err := ioutil.ReadFile(serviceAccountToken)
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	caCert, err := ioutil.ReadFile(serviceAccountCA)
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	httpClient, err := httpClientWithCA(caCert)
+	if err != nil {
+		return nil, err
+	}
+	return &inClusterClient{
+		host:  "https://" + host + ":" + port,
+		http:  httpClient,
+		token: strings.TrimSpace(string(token)),
+	}, nil
+}
+
+func (c *inClusterClient) leaseURL(namespace, name string) string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", c.host, namespace, name)
+}
+
+// tryAcquireOrRenew fetches the Lease (creating it if missing) and claims or renews it if
+// it is unheld, expired, or already held by identity.
+func (c *inClusterClient) tryAcquireOrRenew(ctx context.Context, namespace, name, identity string) (bool, error) {
+	lease, err := c.getLease(ctx, namespace, name)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	held := lease != nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != ""
+	expired := true
+	if held && lease.Spec.RenewTime != nil {
+		if renewTime, parseErr := time.Parse(time.RFC3339, *lease.Spec.RenewTime); parseErr == nil {
+			expired = time.Since(renewTime) > leaseDuration
+		}
+	}
+	ownedByUs := held && *lease.Spec.HolderIdentity == identity
+
+	if held && !expired && !ownedByUs {
+		return false, nil
+	}
+
+	durationSeconds := int32(leaseDuration.Seconds())
+	req := leaseRequest{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &durationSeconds,
+		RenewTime:            &now,
+	}
+	if err := c.upsertLease(ctx, namespace, name, lease, req); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *inClusterClient) getLease(ctx context.Context, namespace, name string) (*leaseObject, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.leaseURL(namespace, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET lease %s/%s: unexpected status %s", namespace, name, resp.Status)
+	}
+	var lease leaseObject
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (c *inClusterClient) upsertLease(ctx context.Context, namespace, name string, existing *leaseObject, spec leaseRequest) error {
+	body := map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}
+
+	method := http.MethodPost
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", c.host, namespace)
+	if existing != nil {
+		method = http.MethodPut
+		url = c.leaseURL(namespace, name)
+		body["metadata"].(map[string]interface{})["resourceVersion"] = existing.Metadata.ResourceVersion
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s lease %s/%s: unexpected status %s", method, namespace, name, resp.Status)
+	}
+	return nil
+}
+
+func httpClientWithCA(caCert []byte) (*http.Client, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to parse service account CA certificate")
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		},
+		Timeout: leaseRenewPeriod,
+	}, nil
+}
+
+func podIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return strconv.Itoa(os.Getpid())
+	}
+	return hostname
+}
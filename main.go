@@ -28,17 +28,16 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/edwarnicke/grpcfd"
 
-	"github.com/NikitaSkrynnik/sdk/pkg/registry/common/authorize"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/opentelemetry"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/token"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/tracing"
 
-	"github.com/NikitaSkrynnik/sdk/pkg/networkservice/chains/nsmgrproxy"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/spiffejwt"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
@@ -50,7 +49,6 @@ import (
 	"google.golang.org/grpc/credentials"
 
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/debug"
-	"github.com/NikitaSkrynnik/sdk/pkg/tools/grpcutils"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/listenonurl"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
 	"github.com/NikitaSkrynnik/sdk/pkg/tools/log/logruslogger"
@@ -58,25 +56,32 @@ import (
 
 // Config is configuration for cmd-nsmgr-proxy
 type Config struct {
-	ListenOn               []url.URL     `default:"unix:///listen.on.socket" desc:"url to listen on." split_words:"true"`
-	Name                   string        `default:"nsmgr-proxy" desc:"Name of Network service manager proxy"`
-	MaxTokenLifetime       time.Duration `default:"10m" desc:"maximum lifetime of tokens" split_words:"true"`
-	RegistryServerPolicies []string      `default:"etc/nsm/opa/common/.*.rego,etc/nsm/opa/registry/.*.rego,etc/nsm/opa/server/.*.rego" desc:"paths to files and directories that contain registry server policies" split_words:"true"`
-	RegistryClientPolicies []string      `default:"etc/nsm/opa/common/.*.rego,etc/nsm/opa/registry/.*.rego,etc/nsm/opa/client/.*.rego" desc:"paths to files and directories that contain registry client policies" split_words:"true"`
-	MapIPFilePath          string        `default:"map-ip.yaml" desc:"Path to file that contains map of internal to external IPs" split_words:"true"`
-	RegistryProxyURL       *url.URL      `desc:"URL to registry proxy. All incoming interdomain registry requests will be proxying by the URL" split_words:"true"`
-	RegistryURL            *url.URL      `desc:"URL to registry. All incoming local registry requests will be proxying by the URL" split_words:"true"`
-	LogLevel               string        `default:"INFO" desc:"Log level" split_words:"true"`
-	OpenTelemetryEndpoint  string        `default:"otel-collector.observability.svc.cluster.local:4317" desc:"OpenTelemetry Collector Endpoint"`
+	ListenOn                []url.URL     `default:"unix:///listen.on.socket" desc:"url to listen on." split_words:"true"`
+	Name                    string        `default:"nsmgr-proxy" desc:"Name of Network service manager proxy"`
+	MaxTokenLifetime        time.Duration `default:"10m" desc:"maximum lifetime of tokens" split_words:"true"`
+	RegistryServerPolicies  []string      `default:"etc/nsm/opa/common/.*.rego,etc/nsm/opa/registry/.*.rego,etc/nsm/opa/server/.*.rego" desc:"paths to files and directories that contain registry server policies" split_words:"true"`
+	RegistryClientPolicies  []string      `default:"etc/nsm/opa/common/.*.rego,etc/nsm/opa/registry/.*.rego,etc/nsm/opa/client/.*.rego" desc:"paths to files and directories that contain registry client policies" split_words:"true"`
+	MapIPFilePath           string        `default:"map-ip.yaml" desc:"Path to file that contains map of internal to external IPs" split_words:"true"`
+	RegistryProxyURL        *url.URL      `desc:"URL to registry proxy. All incoming interdomain registry requests will be proxying by the URL" split_words:"true"`
+	RegistryURL             *url.URL      `desc:"URL to registry. All incoming local registry requests will be proxying by the URL" split_words:"true"`
+	RegistryProxyDiscovery  string        `default:"static://" desc:"backend used to discover the registry-proxy for an interdomain request's target domain: static://, dns:// or consul://addr" split_words:"true"`
+	LogLevel                string        `default:"INFO" desc:"Log level" split_words:"true"`
+	LogFormat               string        `default:"text" desc:"format of log output: text or json" split_words:"true"`
+	OpenTelemetryEndpoint   string        `default:"otel-collector.observability.svc.cluster.local:4317" desc:"OpenTelemetry Collector Endpoint"`
+	HealthListenOn          *url.URL      `desc:"url to listen on for plain HTTP /healthz and /readyz probes. If unset, only the grpc.health.v1.Health service on ListenOn is available" split_words:"true"`
+	LeaderElection          bool          `default:"false" desc:"enable leader election so that only one replica serves interdomain registry writes" split_words:"true"`
+	LeaderElectionNamespace string        `default:"nsm-system" desc:"namespace of the Lease object used for leader election" split_words:"true"`
+	LeaderElectionLeaseName string        `default:"nsmgr-proxy" desc:"name of the Lease object used for leader election" split_words:"true"`
+	PrometheusListenOn      *url.URL      `desc:"url to listen on for a Prometheus /metrics scrape endpoint. If unset, metrics are only available via the OpenTelemetry Collector" split_words:"true"`
 }
 
 func main() {
-	// Setup context to catch signals
+	// Setup context to catch signals. SIGHUP is handled separately by watchReload to
+	// trigger a config reload instead of shutting the process down.
 	ctx, cancel := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt,
 		// More Linux signals here
-		syscall.SIGHUP,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
 	)
@@ -110,6 +115,13 @@ func main() {
 	}
 	logrus.SetLevel(l)
 
+	switch strings.ToLower(config.LogFormat) {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.SetFormatter(&nested.Formatter{})
+	}
+
 	log.FromContext(ctx).Infof("Config: %#v", config)
 
 	// Configure Open Telemetry
@@ -142,8 +154,11 @@ func main() {
 	tlsServerConfig.MinVersion = tls.VersionTLS12
 
 	tlsCreds := credentials.NewTLS(tlsServerConfig)
-	// Create GRPC Server and register services
-	server := grpc.NewServer(append(tracing.WithTracing(), grpc.Creds(tlsCreds))...)
+
+	// registryMetrics backs the optional Prometheus /metrics endpoint alongside the
+	// existing OpenTelemetry Collector export; it is a harmless no-op when
+	// PrometheusListenOn is unset.
+	registryMetrics := newRegistryMetrics(ctx, config.PrometheusListenOn != nil)
 
 	dialOptions := append(
 		tracing.WithTracingDial(),
@@ -159,34 +174,44 @@ func main() {
 		),
 		grpcfd.WithChainStreamInterceptor(),
 		grpcfd.WithChainUnaryInterceptor(),
+		grpc.WithChainUnaryInterceptor(requestIDUnaryClientInterceptor(), metricsUnaryClientInterceptor(registryMetrics)),
+		grpc.WithChainStreamInterceptor(requestIDStreamClientInterceptor()),
+		grpc.WithStatsHandler(&connCountStatsHandler{m: registryMetrics}),
 	)
 
-	listenURL := getPublishableURL(config.ListenOn, log.FromContext(ctx))
-
-	log.FromContext(ctx).Infof("Listening url: %v", listenURL)
-
-	nsmgrproxy.NewServer(
-		ctx,
-		config.RegistryURL,
-		config.RegistryProxyURL,
-		spiffejwt.TokenGeneratorFunc(source, config.MaxTokenLifetime),
-		nsmgrproxy.WithName(config.Name),
-		nsmgrproxy.WithListenOn(listenURL),
-		nsmgrproxy.WithDialOptions(dialOptions...),
-		nsmgrproxy.WithMapIPFilePath(config.MapIPFilePath),
-		nsmgrproxy.WithAuthorizeNSERegistryServer(authorize.NewNetworkServiceEndpointRegistryServer(authorize.WithPolicies(
-			config.RegistryServerPolicies...))),
-		nsmgrproxy.WithAuthorizeNSERegistryClient(authorize.NewNetworkServiceEndpointRegistryClient(authorize.WithPolicies(
-			config.RegistryClientPolicies...))),
-		nsmgrproxy.WithAuthorizeNSRegistryServer(authorize.NewNetworkServiceRegistryServer(authorize.WithPolicies(
-			config.RegistryServerPolicies...))),
-		nsmgrproxy.WithAuthorizeNSRegistryClient(authorize.NewNetworkServiceRegistryClient(authorize.WithPolicies(
-			config.RegistryClientPolicies...))),
-	).Register(server)
-
-	for i := 0; i < len(config.ListenOn); i++ {
-		srvErrCh := grpcutils.ListenAndServe(ctx, &config.ListenOn[i], server)
-		exitOnErr(ctx, cancel, srvErrCh)
+	// healthServer is shared by the grpc.health.v1.Health service and the HTTP
+	// /healthz and /readyz endpoints, and survives a config reload of the runner below.
+	healthServer := newHealthServer()
+	readiness := newReadiness(healthServer, config.LeaderElection)
+
+	var leader *leaderState
+	if config.LeaderElection {
+		leader = &leaderState{}
+	}
+
+	runner := newProxyRunner(source, tlsCreds, dialOptions, healthServer, readiness, leader, registryMetrics, config.ListenOn, config.Name, config.MaxTokenLifetime)
+	runner.start(ctx, config)
+
+	go monitorUpstreams(ctx, readiness, dialOptions, runner.registryTargets)
+	go watchReload(ctx, runner, config)
+
+	elector := newLeaderElector(config, podIdentity())
+	go func() {
+		if runErr := elector.Run(ctx, func(isLeader bool) {
+			if leader != nil {
+				leader.set(isLeader)
+			}
+			readiness.setLeader(isLeader)
+		}); runErr != nil && ctx.Err() == nil {
+			log.FromContext(ctx).Errorf("leader election: %+v", runErr)
+		}
+	}()
+
+	if config.HealthListenOn != nil {
+		logHealthErr(ctx, serveHTTPHealth(ctx, config.HealthListenOn, healthServer))
+	}
+	if config.PrometheusListenOn != nil {
+		logHealthErr(ctx, serveHTTPMetrics(ctx, config.PrometheusListenOn))
 	}
 
 	log.FromContext(ctx).Infof("Startup completed in %v", time.Since(startTime))
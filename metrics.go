@@ -0,0 +1,240 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
+)
+
+// registryMetrics instruments the requests this proxy handles and the interdomain
+// forwards/dials it makes to remote registries and registry-proxies, and serves them on a
+// dedicated Prometheus MeterProvider reader so operators who scrape Prometheus directly
+// (instead of, or in addition to, an OTLP collector) aren't left with zero visibility.
+// A registryMetrics with a nil provider is a valid no-op value, matching the existing
+// opentelemetry.IsEnabled() pattern of a harmless zero value rather than a nil pointer.
+type registryMetrics struct {
+	provider *sdkmetric.MeterProvider
+
+	requestsTotal     metric.Int64Counter
+	forwardLatency    metric.Float64Histogram
+	activeConnections metric.Int64UpDownCounter
+}
+
+// newRegistryMetrics builds the Prometheus-backed instruments when enabled is true.
+// enabled false returns a registryMetrics whose recording methods are no-ops.
+func newRegistryMetrics(ctx context.Context, enabled bool) *registryMetrics {
+	if !enabled {
+		return &registryMetrics{}
+	}
+
+	exporter, err := prometheus.New()
+	if err != nil {
+		log.FromContext(ctx).Errorf("metrics: failed to create prometheus exporter: %+v", err)
+		return &registryMetrics{}
+	}
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
+	meter := provider.Meter("nsmgrproxy")
+
+	m := &registryMetrics{provider: provider}
+
+	if m.requestsTotal, err = meter.Int64Counter(
+		"nsmgrproxy_registry_requests_total",
+		metric.WithDescription("Total number of registry requests handled, by operation, registry type and result"),
+	); err != nil {
+		log.FromContext(ctx).Errorf("metrics: %+v", err)
+	}
+	if m.forwardLatency, err = meter.Float64Histogram(
+		"nsmgrproxy_interdomain_forward_latency_seconds",
+		metric.WithDescription("Latency of registry requests forwarded to a remote domain's registry-proxy"),
+	); err != nil {
+		log.FromContext(ctx).Errorf("metrics: %+v", err)
+	}
+	if m.activeConnections, err = meter.Int64UpDownCounter(
+		"nsmgrproxy_active_peer_connections",
+		metric.WithDescription("Number of currently dialed connections to registry/registry-proxy peers"),
+	); err != nil {
+		log.FromContext(ctx).Errorf("metrics: %+v", err)
+	}
+
+	return m
+}
+
+func (m *registryMetrics) recordRequest(ctx context.Context, op, registryType, result string) {
+	if m == nil || m.requestsTotal == nil {
+		return
+	}
+	m.requestsTotal.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("op", op),
+		attribute.String("type", registryType),
+		attribute.String("result", result),
+	))
+}
+
+func (m *registryMetrics) recordForwardLatency(ctx context.Context, seconds float64) {
+	if m == nil || m.forwardLatency == nil {
+		return
+	}
+	m.forwardLatency.Record(ctx, seconds)
+}
+
+func (m *registryMetrics) addActiveConnections(ctx context.Context, delta int64) {
+	if m == nil || m.activeConnections == nil {
+		return
+	}
+	m.activeConnections.Add(ctx, delta)
+}
+
+// serveHTTPMetrics exposes the Prometheus /metrics scrape endpoint on listenOn.
+func serveHTTPMetrics(ctx context.Context, listenOn *url.URL) <-chan error {
+	errCh := make(chan error, 1)
+
+	ln, err := net.Listen("tcp", listenOn.Host)
+	if err != nil {
+		errCh <- err
+		close(errCh)
+		return errCh
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	return errCh
+}
+
+// metricsUnaryServerInterceptor records nsmgrproxy_registry_requests_total for every
+// registry RPC this proxy serves locally.
+func metricsUnaryServerInterceptor(m *registryMetrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+
+		op, registryType := splitRegistryMethod(info.FullMethod)
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		m.recordRequest(ctx, op, registryType, result)
+
+		return resp, err
+	}
+}
+
+// metricsStreamServerInterceptor records nsmgrproxy_registry_requests_total for every
+// registry RPC this proxy serves locally as a server stream, i.e. NetworkServiceRegistry.Find
+// and NetworkServiceEndpointRegistry.Find, the dominant registry operations in practice. These
+// never pass through metricsUnaryServerInterceptor since they aren't unary RPCs.
+func metricsStreamServerInterceptor(m *registryMetrics) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+
+		op, registryType := splitRegistryMethod(info.FullMethod)
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		m.recordRequest(ss.Context(), op, registryType, result)
+
+		return err
+	}
+}
+
+// metricsUnaryClientInterceptor records nsmgrproxy_interdomain_forward_latency_seconds for
+// every unary RPC made over a connection dialed with dialOptions, i.e. unary forwards to a
+// remote registry-proxy as well as unary calls to the local registry. Streaming calls such
+// as Find are not timed.
+func metricsUnaryClientInterceptor(m *registryMetrics) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		m.recordForwardLatency(ctx, time.Since(start).Seconds())
+		return err
+	}
+}
+
+// connCountStatsHandler tracks nsmgrproxy_active_peer_connections across every connection
+// dialed with dialOptions.
+type connCountStatsHandler struct {
+	m *registryMetrics
+}
+
+func (h *connCountStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *connCountStatsHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (h *connCountStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *connCountStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		h.m.addActiveConnections(ctx, 1)
+	case *stats.ConnEnd:
+		h.m.addActiveConnections(ctx, -1)
+	}
+}
+
+// splitRegistryMethod splits a full grpc method name into its operation (e.g. "Register")
+// and a short registry type label (e.g. "network-service-endpoint").
+func splitRegistryMethod(fullMethod string) (op, registryType string) {
+	parts := strings.Split(strings.TrimPrefix(fullMethod, "/"), "/")
+	if len(parts) != 2 {
+		return fullMethod, "unknown"
+	}
+	service, op := parts[0], parts[1]
+
+	switch {
+	case strings.HasSuffix(service, "NetworkServiceEndpointRegistry"):
+		registryType = "network-service-endpoint"
+	case strings.HasSuffix(service, "NetworkServiceRegistry"):
+		registryType = "network-service"
+	default:
+		registryType = service
+	}
+	return op, registryType
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/grpcutils"
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/tracing"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// proxyRunner owns the currently running interdomainRouter grpc chain and rebuilds it
+// whenever MapIPFilePath, the OPA policy paths, RegistryURL or RegistryProxyURL change, so
+// that operators can roll out new interdomain IP mappings or OPA rules without restarting
+// the pod. Everything that must not change across a reload (listen addresses, TLS, dial
+// options, the SPIFFE source, the shared health server) is captured once at construction.
+type proxyRunner struct {
+	source           *workloadapi.X509Source
+	tlsCreds         credentials.TransportCredentials
+	dialOptions      []grpc.DialOption
+	healthServer     *health.Server
+	readiness        *readiness
+	leaderState      *leaderState
+	metrics          *registryMetrics
+	listenOn         []url.URL
+	name             string
+	maxTokenLifetime time.Duration
+
+	mu          sync.Mutex
+	server      *grpc.Server
+	serveCancel context.CancelFunc
+
+	registryURL            *url.URL
+	discovery              registryProxyDiscovery
+	registryProxyURL       *url.URL
+	router                 *interdomainRouter
+	mapIPFilePath          string
+	registryServerPolicies []string
+	registryClientPolicies []string
+}
+
+func newProxyRunner(source *workloadapi.X509Source, tlsCreds credentials.TransportCredentials, dialOptions []grpc.DialOption, healthServer *health.Server, readiness *readiness, leaderState *leaderState, metrics *registryMetrics, listenOn []url.URL, name string, maxTokenLifetime time.Duration) *proxyRunner {
+	return &proxyRunner{
+		source:           source,
+		tlsCreds:         tlsCreds,
+		dialOptions:      dialOptions,
+		healthServer:     healthServer,
+		readiness:        readiness,
+		leaderState:      leaderState,
+		metrics:          metrics,
+		listenOn:         listenOn,
+		name:             name,
+		maxTokenLifetime: maxTokenLifetime,
+	}
+}
+
+// start builds the nsmgrproxy chain for the first time from config and begins serving on
+// listenOn. There is nothing previously serving to fall back to, so a bind failure here is
+// fatal, same as any other startup error. Readiness only flips to SERVING once the registry
+// and registry-proxy upstreams have actually been dialed successfully, since the chain
+// itself only wires up lazy dialers and proves nothing about upstream reachability on its
+// own.
+func (r *proxyRunner) start(ctx context.Context, config *Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.setFieldsLocked(ctx, config)
+	if err := r.serveLocked(ctx); err != nil {
+		log.FromContext(ctx).Fatal(errors.Wrap(err, "start: failed to bind nsmgr-proxy chain"))
+	}
+	r.readiness.setUpstreamsOK(upstreamsReachable(ctx, r.dialOptions, r.registryURL, r.registryProxyURL))
+}
+
+// reloadDrainTimeout bounds how long reload waits for the old server to drain in-flight
+// RPCs before forcing it closed. NetworkServiceRegistry.Find/NetworkServiceEndpointRegistry.Find
+// are server-streaming watch subscriptions that routinely stay open for the life of a peer's
+// connection, so an unbounded GracefulStop taken under r.mu would otherwise hang every
+// future reload for as long as any peer keeps a watch open.
+const reloadDrainTimeout = 10 * time.Second
+
+// reload rebuilds the nsmgrproxy chain from config and swaps it in for the running one. The
+// old server is stopped first so its listeners free their ports before the new chain tries
+// to bind them: binding the new chain first would race the old listeners for the same
+// tcp://host:port and, on most platforms, lose with EADDRINUSE. If the new chain fails to
+// bind, the proxy is left down (accepting a short gap in service) rather than torn down a
+// second time or crashed via log.Fatal, since a routine SIGHUP/fsnotify reload should never
+// be able to take the whole pod down.
+func (r *proxyRunner) reload(ctx context.Context, config *Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.FromContext(ctx).Infof("reload: rebuilding nsmgr-proxy chain")
+
+	stopOldServerLocked(ctx, r.server)
+	if r.serveCancel != nil {
+		r.serveCancel()
+	}
+	r.server = nil
+	r.serveCancel = nil
+
+	r.setFieldsLocked(ctx, config)
+	if err := r.serveLocked(ctx); err != nil {
+		log.FromContext(ctx).Errorf("reload: failed to bind new nsmgr-proxy chain, proxy is down until the next reload: %+v", err)
+		r.readiness.setUpstreamsOK(false)
+		return
+	}
+
+	r.readiness.setUpstreamsOK(upstreamsReachable(ctx, r.dialOptions, r.registryURL, r.registryProxyURL))
+	log.FromContext(ctx).Infof("reload: nsmgr-proxy chain reloaded")
+}
+
+// stopOldServerLocked stops server, preferring a graceful drain of in-flight RPCs but
+// falling back to an immediate Stop if that takes longer than reloadDrainTimeout. server.Stop
+// causes a concurrently running GracefulStop to return soon after, so the goroutine below
+// always completes.
+func stopOldServerLocked(ctx context.Context, server *grpc.Server) {
+	if server == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(reloadDrainTimeout):
+		log.FromContext(ctx).Warnf("reload: old server did not drain within %v, forcing stop", reloadDrainTimeout)
+		server.Stop()
+		<-done
+	}
+}
+
+// setFieldsLocked re-reads the reloadable fields from config, including a fresh
+// registryProxyDiscovery backend: discovery itself is resolved per request against the
+// interdomain domain of each registry call (see interdomainRouter), not once here, so this
+// only needs to pick the backend and keep registryProxyURL around as its static fallback
+// for purely local (non-interdomain) requests.
+func (r *proxyRunner) setFieldsLocked(ctx context.Context, config *Config) {
+	r.registryURL = config.RegistryURL
+	r.registryProxyURL = config.RegistryProxyURL
+	r.mapIPFilePath = config.MapIPFilePath
+	r.registryServerPolicies = config.RegistryServerPolicies
+	r.registryClientPolicies = config.RegistryClientPolicies
+
+	discovery, err := newRegistryProxyDiscovery(config.RegistryProxyDiscovery, config.RegistryProxyURL)
+	if err != nil {
+		log.FromContext(ctx).Errorf("registry-proxy discovery: %+v, falling back to static RegistryProxyURL", err)
+		discovery = staticRegistryProxyDiscovery{url: config.RegistryProxyURL}
+	}
+	r.discovery = discovery
+}
+
+// serveLocked builds a fresh grpc.Server for the current fields and starts listening on
+// listenOn, returning an error if any listener fails to bind. Callers must hold r.mu.
+func (r *proxyRunner) serveLocked(ctx context.Context) error {
+	serveCtx, cancel := context.WithCancel(ctx)
+
+	serverOptions := append(tracing.WithTracing(),
+		grpc.Creds(r.tlsCreds),
+		grpc.ChainUnaryInterceptor(requestIDUnaryServerInterceptor(), metricsUnaryServerInterceptor(r.metrics)),
+		grpc.ChainStreamInterceptor(requestIDStreamServerInterceptor(), metricsStreamServerInterceptor(r.metrics)),
+	)
+	if r.leaderState != nil {
+		serverOptions = append(serverOptions, grpc.ChainUnaryInterceptor(leaderUnaryInterceptor(r.leaderState)))
+	}
+	server := grpc.NewServer(serverOptions...)
+	registerHealthServer(server, r.healthServer)
+
+	listenURL := getPublishableURL(r.listenOn, log.FromContext(serveCtx))
+	log.FromContext(serveCtx).Infof("Listening url: %v", listenURL)
+
+	router := newInterdomainRouter(
+		serveCtx,
+		r.source,
+		r.dialOptions,
+		r.discovery,
+		r.registryProxyURL,
+		r.registryURL,
+		r.name,
+		listenURL,
+		r.mapIPFilePath,
+		r.maxTokenLifetime,
+		r.registryServerPolicies,
+		r.registryClientPolicies,
+	)
+	router.Register(server)
+
+	for i := range r.listenOn {
+		errCh := grpcutils.ListenAndServe(serveCtx, &r.listenOn[i], server)
+		if err := checkListenErr(serveCtx, cancel, errCh); err != nil {
+			cancel()
+			return errors.Wrapf(err, "binding listener %v", &r.listenOn[i])
+		}
+	}
+
+	r.server = server
+	r.serveCancel = cancel
+	r.router = router
+	return nil
+}
+
+// checkListenErr makes the same immediate, non-blocking check as exitOnErr, but returns an
+// already-present bind error to the caller instead of calling log.Fatal: serveLocked needs to
+// report a bind failure to reload() without crashing the process. An error that arrives later,
+// after a successful bind, is still logged and cancels serveCtx exactly like exitOnErr, since
+// that case isn't a reload-ordering problem and shouldn't be handled any differently.
+func checkListenErr(ctx context.Context, cancel context.CancelFunc, errCh <-chan error) error {
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+	go func(ctx context.Context, errCh <-chan error) {
+		err := <-errCh
+		log.FromContext(ctx).Error(err)
+		cancel()
+	}(ctx, errCh)
+	return nil
+}
+
+// registryTargets returns the registry URL, the static registry-proxy URL and every
+// registry-proxy URL currently resolved via discovery, for monitorUpstreams to re-dial on
+// every tick. Without the resolved URLs, a deployment that leaves RegistryProxyURL unset in
+// favor of dns:///consul:// discovery would have nothing for monitorUpstreams to dial,
+// silently skipping all of them and never detecting a broken discovered upstream.
+func (r *proxyRunner) registryTargets() []*url.URL {
+	r.mu.Lock()
+	targets := []*url.URL{r.registryURL, r.registryProxyURL}
+	router := r.router
+	r.mu.Unlock()
+
+	if router != nil {
+		targets = append(targets, router.resolvedProxyURLs()...)
+	}
+	return targets
+}
+
+// watchReload triggers runner.reload(config) whenever SIGHUP is received, or whenever a
+// file under MapIPFilePath or one of the OPA policy paths changes on disk. config is
+// re-read from the process environment on every trigger; that environment is fixed when
+// the process starts, so RegistryURL and RegistryProxyURL keep their startup values across
+// a reload. It runs until ctx is Done.
+func watchReload(ctx context.Context, runner *proxyRunner, config *Config) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.FromContext(ctx).Errorf("reload: failed to start fsnotify watcher: %+v", err)
+	} else {
+		defer func() { _ = watcher.Close() }()
+		for _, dir := range reloadWatchDirs(config) {
+			if watchErr := watcher.Add(dir); watchErr != nil {
+				log.FromContext(ctx).Warnf("reload: failed to watch %v: %+v", dir, watchErr)
+			}
+		}
+	}
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			log.FromContext(ctx).Infof("reload: SIGHUP received")
+			reloadConfig(ctx, runner, config)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				log.FromContext(ctx).Infof("reload: %v changed", event.Name)
+				reloadConfig(ctx, runner, config)
+			}
+		}
+	}
+}
+
+// reloadConfig re-processes config from the environment in place and hands the result to
+// runner.reload.
+func reloadConfig(ctx context.Context, runner *proxyRunner, config *Config) {
+	next := *config
+	if err := envconfig.Process("nsm", &next); err != nil {
+		log.FromContext(ctx).Errorf("reload: failed to reprocess config from env: %+v", err)
+		return
+	}
+	*config = next
+	runner.reload(ctx, config)
+}
+
+// reloadWatchDirs returns the set of directories fsnotify should watch to notice changes
+// to MapIPFilePath or any of the OPA rego policy paths.
+func reloadWatchDirs(config *Config) []string {
+	dirs := map[string]struct{}{filepath.Dir(config.MapIPFilePath): {}}
+	for _, pattern := range config.RegistryServerPolicies {
+		dirs[filepath.Dir(pattern)] = struct{}{}
+	}
+	for _, pattern := range config.RegistryClientPolicies {
+		dirs[filepath.Dir(pattern)] = struct{}{}
+	}
+
+	result := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		result = append(result, dir)
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2023 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log"
+	"github.com/NikitaSkrynnik/sdk/pkg/tools/log/logruslogger"
+)
+
+// requestIDMetadataKey is the grpc metadata key nsmgr/nsmgr-proxy chains use to propagate
+// a correlation id end-to-end across the client->nsmgr->nsmgr-proxy->remote-nsmgr chain.
+const requestIDMetadataKey = "x-nsm-request-id"
+
+type requestIDContextKey struct{}
+
+// requestIDUnaryServerInterceptor extracts requestIDMetadataKey from the incoming grpc
+// metadata (generating one via uuid if it is missing) and attaches it to both the context
+// logger and the context itself, so requestIDUnaryClientInterceptor can propagate the same
+// id on any dial made while handling this request.
+func requestIDUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ctxWithRequestID(ctx), req)
+	}
+}
+
+// requestIDStreamServerInterceptor is the streaming-RPC counterpart of
+// requestIDUnaryServerInterceptor, used for registry Find subscriptions.
+func requestIDStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &requestIDServerStream{ServerStream: ss, ctx: ctxWithRequestID(ss.Context())})
+	}
+}
+
+type requestIDServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func ctxWithRequestID(ctx context.Context) context.Context {
+	id := requestIDFromIncomingMetadata(ctx)
+	if id == "" {
+		id = uuid.NewString()
+	}
+	ctx = context.WithValue(ctx, requestIDContextKey{}, id)
+	return log.WithLog(ctx, logruslogger.New(ctx, map[string]interface{}{"request-id": id}))
+}
+
+func requestIDFromIncomingMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(requestIDMetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// requestIDUnaryClientInterceptor propagates the request id attached to ctx onto the
+// outgoing requestIDMetadataKey metadata of every unary RPC made over a connection dialed
+// with dialOptions, generating one when ctx doesn't already carry one.
+func requestIDUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingCtxWithRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// requestIDStreamClientInterceptor is the streaming-RPC counterpart of
+// requestIDUnaryClientInterceptor, used for interdomain registry Find forwarding.
+func requestIDStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingCtxWithRequestID(ctx), desc, cc, method, opts...)
+	}
+}
+
+func outgoingCtxWithRequestID(ctx context.Context) context.Context {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	if !ok || id == "" {
+		id = uuid.NewString()
+	}
+	return metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+}